@@ -0,0 +1,130 @@
+// Command chunkbench evaluates a chunking strategy against a corpus of
+// captured responses: it reports the resulting dictionary size and the
+// delta ratio achieved when diffing the last corpus file (in directory
+// order) against a dictionary built from all the others, so changes to
+// pkg/dict's Chunker
+// implementations can be compared before they're wired into the server.
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/rakoo/mmas/pkg/dict"
+	"github.com/rakoo/mmas/pkg/dict/vcdiff"
+)
+
+func main() {
+	corpusDir := flag.String("corpus", "", "directory of captured response bodies to benchmark against")
+	chunker := flag.String("chunker", "fastcdc", "chunker to evaluate: fastcdc or rollsum")
+	bits := flag.Int("rollsum-bits", 13, "rollsum split bits, only used when -chunker=rollsum")
+	flag.Parse()
+
+	if *corpusDir == "" {
+		log.Fatal("chunkbench: -corpus is required")
+	}
+
+	files, err := readCorpus(*corpusDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) < 2 {
+		log.Fatal("chunkbench: need at least 2 corpus files: one to build the dictionary, one to diff")
+	}
+
+	newChunker := func() dict.Chunker { return dict.DefaultFastCDC() }
+	if *chunker == "rollsum" {
+		newChunker = func() dict.Chunker { return dict.NewRollsumChunker(*bits) }
+	}
+
+	dictContent, chunkCount := buildDict(files[:len(files)-1], newChunker)
+	enc := vcdiff.NewEncoder(dictContent)
+
+	var totalIn, totalOut int
+	for _, f := range files[len(files)-1:] {
+		diff, err := enc.Encode(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		totalIn += len(f)
+		totalOut += len(diff)
+	}
+
+	fmt.Printf("chunker:        %s\n", *chunker)
+	fmt.Printf("corpus files:   %d\n", len(files))
+	fmt.Printf("dict chunks:    %d\n", chunkCount)
+	fmt.Printf("dict size:      %d bytes\n", len(dictContent))
+	fmt.Printf("delta ratio:    %.2f%% (%d/%d bytes)\n", 100*float64(totalOut)/float64(totalIn), totalOut, totalIn)
+}
+
+// buildDict chunks every file in files with newChunker and keeps the
+// chunks seen more than once, the same count>1 threshold pkg/dict.needToUpdate
+// uses to decide what's worth training on.
+func buildDict(files [][]byte, newChunker func() dict.Chunker) (contents []byte, chunkCount int) {
+	counts := make(map[string]int)
+	chunks := make(map[string][]byte)
+	var order []string
+
+	for _, f := range files {
+		c := newChunker()
+		var buf []byte
+		for _, b := range f {
+			c.Roll(b)
+			buf = append(buf, b)
+			if c.OnSplit() {
+				addChunk(buf, counts, chunks, &order)
+				buf = buf[:0]
+			}
+		}
+		if len(buf) > 0 {
+			addChunk(buf, counts, chunks, &order)
+		}
+	}
+
+	sort.Strings(order)
+	for _, h := range order {
+		if counts[h] > 1 {
+			contents = append(contents, chunks[h]...)
+			chunkCount++
+		}
+	}
+	return contents, chunkCount
+}
+
+func addChunk(buf []byte, counts map[string]int, chunks map[string][]byte, order *[]string) {
+	h := sha1.Sum(buf)
+	key := string(h[:])
+	if _, ok := chunks[key]; !ok {
+		chunks[key] = append([]byte{}, buf...)
+		*order = append(*order, key)
+	}
+	counts[key]++
+}
+
+func readCorpus(dir string) ([][]byte, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files [][]byte
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, content)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("chunkbench: no files in %s", dir)
+	}
+	return files, nil
+}
@@ -0,0 +1,130 @@
+package dict
+
+import (
+	"math/rand"
+
+	"camlistore.org/pkg/rollsum"
+)
+
+// Chunker finds content-defined chunk boundaries one byte at a time, the
+// same shape rollsum already used: feed it bytes via Roll, and ask
+// OnSplit after each one whether a chunk boundary falls right there.
+type Chunker interface {
+	Roll(b byte)
+	OnSplit() bool
+}
+
+// rollsumRoller is the subset of camlistore's *rollsum.RollSum API we
+// adapt to Chunker.
+type rollsumRoller interface {
+	Roll(byte)
+	OnSplitWithBits(uint32) bool
+}
+
+// rollsumChunker adapts camlistore's rollsum to the Chunker interface. It
+// stays available alongside FastCDC purely so the two can be compared
+// against each other (see cmd/chunkbench); FastCDC is the default because
+// rollsum's OnSplitWithBits(5) averages ~32-byte chunks, far too small for
+// an SDCH dictionary corpus.
+type rollsumChunker struct {
+	rs   rollsumRoller
+	bits int
+}
+
+// NewRollsumChunker returns a Chunker backed by rollsum, splitting when
+// its low bits bits of the checksum are zero (so average chunk size is
+// roughly 2^bits bytes).
+func NewRollsumChunker(bits int) Chunker {
+	return &rollsumChunker{rs: rollsum.New(), bits: bits}
+}
+
+func (c *rollsumChunker) Roll(b byte)   { c.rs.Roll(b) }
+func (c *rollsumChunker) OnSplit() bool { return c.rs.OnSplitWithBits(uint32(c.bits)) }
+
+// FastCDC implements content-defined chunking per Xia et al.'s "FastCDC:
+// a Fast and Efficient Content-Defined Chunking Approach for Data
+// Deduplication", normalized to keep chunk sizes clustered around avg
+// rather than following the geometric distribution a naive rolling hash
+// produces.
+type FastCDC struct {
+	min, avg, max int
+	maskS, maskL  uint64
+
+	fp uint64 // rolling gear-hash fingerprint since the last split
+	n  int    // bytes rolled since the last split
+}
+
+// NewFastCDC returns a FastCDC chunker targeting the given min/avg/max
+// chunk sizes in bytes.
+func NewFastCDC(min, avg, max int) *FastCDC {
+	maskS, maskL := cdcMasks(avg)
+	return &FastCDC{min: min, avg: avg, max: max, maskS: maskS, maskL: maskL}
+}
+
+// DefaultFastCDC returns a FastCDC chunker tuned for an SDCH dictionary
+// corpus: min=2KB, avg=8KB, max=64KB.
+func DefaultFastCDC() *FastCDC {
+	return NewFastCDC(2*1024, 8*1024, 64*1024)
+}
+
+func (c *FastCDC) Roll(b byte) {
+	c.fp = (c.fp << 1) + gearTable[b]
+	c.n++
+}
+
+func (c *FastCDC) OnSplit() bool {
+	if c.n < c.min {
+		return false
+	}
+
+	var split bool
+	switch {
+	case c.n < c.avg:
+		split = c.fp&c.maskS == 0
+	case c.n < c.max:
+		split = c.fp&c.maskL == 0
+	default:
+		split = true
+	}
+
+	if split {
+		c.fp = 0
+		c.n = 0
+	}
+	return split
+}
+
+// cdcMasks derives the two normalized-chunking masks from the target
+// average chunk size: maskS has more one-bits than maskL, so it's harder
+// to satisfy (less likely to split) while a chunk is still smaller than
+// avg, and easier to satisfy (more likely to split) once it's grown past
+// avg — which is what keeps the distribution tight around avg instead of
+// following the wider geometric spread a single mask produces.
+func cdcMasks(avg int) (maskS, maskL uint64) {
+	bits := uint(0)
+	for n := avg; n > 1; n >>= 1 {
+		bits++
+	}
+
+	bitsS := bits + 2
+	bitsL := bits - 2
+	if bitsL < 1 {
+		bitsL = 1
+	}
+
+	return (1 << bitsS) - 1, (1 << bitsL) - 1
+}
+
+// gearTable is FastCDC's per-byte gear hash: 256 fixed pseudo-random
+// 64-bit values, generated once from a fixed seed so chunking is
+// deterministic across runs and builds.
+var gearTable = generateGearTable()
+
+func generateGearTable() [256]uint64 {
+	var t [256]uint64
+	r := rand.New(rand.NewSource(0x4d4d4153)) // "MMAS", just a fixed seed
+	for i := range t {
+		t[i] = r.Uint64()
+	}
+	return t
+}
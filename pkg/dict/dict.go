@@ -4,18 +4,33 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 
-	"camlistore.org/pkg/rollsum"
+	"github.com/rakoo/mmas/pkg/dict/vcdiff"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ErrNoDict is returned by Eat when no dictionary has been built yet, so
+// there's nothing to diff the content against.
+var ErrNoDict = errors.New("dict: no dictionary built yet")
+
+// ErrUnknownGeneration is returned by Eat when the caller's uaId doesn't
+// match any generation we still have an encoder for (either the client
+// never fetched a dictionary, or it fetched one old enough to have been
+// evicted). The caller should fall back to serving uncompressed content;
+// the client will pick up a fresh dictionary via Get-Dictionary.
+var ErrUnknownGeneration = errors.New("dict: unknown dictionary generation")
+
 const (
 	sqlUpSert = `
 	INSERT OR REPLACE INTO chunks VALUES (
@@ -26,17 +41,45 @@ const (
 )
 
 type Dict struct {
+	dir   string
+	scope Scope
+
 	db *sql.DB
 
 	sdchDictChunks [][]byte
 
-	// stats
+	// compactMu serializes a generation swap (writing the new
+	// dicts/<id> file) in makeDict against the background compactor
+	// trimming the chunks table; parse's own chunk inserts don't take
+	// it. Without it the two could race each other's file writes.
+	compactMu sync.Mutex
+
+	// maxChunkBytes bounds the sqlite chunks table; compact() evicts the
+	// lowest-count chunks once the corpus exceeds it. Accessed
+	// atomically so SetMaxChunkBytes can be called concurrently.
+	maxChunkBytes int64
+
+	gensMu sync.RWMutex
+	// gens holds the dictionary's generations, newest first, up to
+	// maxGenerations. Keeping more than one lets a client that's still
+	// holding an older dictionary (per Avail-Dictionary) get a delta it
+	// can actually decode, instead of always diffing against the latest.
+	gens []*generation
+
+	// newChunker builds the Chunker used to split each piece of content
+	// parse() is fed. Defaults to FastCDC; see SetChunker.
+	newChunker func() Chunker
+
+	// stats. parse() runs in its own goroutine per Eat call, so
+	// concurrent requests can update these at once; accessed atomically.
 	totalBytesDup uint64
 	totalBytesIn  uint64
 }
 
-func New() (*Dict, error) {
-	db, err := sql.Open("sqlite3", "dict")
+// New opens (or creates) the Dict backing a single Scope, storing its
+// sqlite database and dictionary generations under dir.
+func New(dir string, scope Scope) (*Dict, error) {
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "dict"))
 	if err != nil {
 		return nil, err
 	}
@@ -56,35 +99,64 @@ CREATE TABLE IF NOT EXISTS chunks (
 		return nil, err
 	}
 
-	return &Dict{
-		db: db,
-	}, nil
+	d := &Dict{
+		dir:           dir,
+		scope:         scope,
+		db:            db,
+		maxChunkBytes: defaultMaxChunkBytes,
+		newChunker:    func() Chunker { return DefaultFastCDC() },
+	}
+	d.startCompactor(defaultCompactInterval)
+	return d, nil
 }
 
-func (d *Dict) Eat(content []byte) (diff []byte, err error) {
+// SetChunker overrides the Chunker used to split content into dictionary
+// candidates; useful for comparing strategies (see cmd/chunkbench).
+func (d *Dict) SetChunker(newChunker func() Chunker) {
+	d.newChunker = newChunker
+}
 
-	var diffBuf bytes.Buffer
-	cmd := exec.Command("vcdiff", "delta", "-dictionary", "dictraw", "-interleaved", "-stats", "-checksum")
-	cmd.Stdin = bytes.NewReader(content)
-	cmd.Stdout = &diffBuf
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return nil, err
+// Eat diffs content against the dictionary generation the client
+// presented as uaId, returning the VCDIFF delta and the id of the
+// generation it was encoded against (which the caller needs to prefix
+// the SDCH body with, since it may not be the latest generation). It
+// always schedules content to be learned from, regardless of whether a
+// usable generation was found.
+func (d *Dict) Eat(content []byte, uaId string) (diff []byte, genId string, err error) {
+	defer func() {
+		go func() {
+			if perr := d.parse(content); perr != nil {
+				log.Println("Error parsing:", perr)
+			}
+		}()
+	}()
+
+	d.gensMu.RLock()
+	defer d.gensMu.RUnlock()
+
+	if len(d.gens) == 0 {
+		return nil, "", ErrNoDict
+	}
+	if uaId == "" {
+		return nil, "", ErrUnknownGeneration
 	}
-	diff = diffBuf.Bytes()
 
-	go func() {
-		err := d.parse(content)
+	for _, g := range d.gens {
+		if g.id != uaId {
+			continue
+		}
+		diff, err = g.enc.Encode(content)
 		if err != nil {
-			log.Println("Error parsing:", err)
+			return nil, "", err
 		}
-	}()
+		return diff, g.id, nil
+	}
 
-	return diff, nil
+	return nil, "", ErrUnknownGeneration
 }
 
 func (d *Dict) parse(content []byte) error {
-	rs := rollsum.New()
+	c := d.newChunker()
 
 	var match uint64
 	q := content
@@ -107,12 +179,12 @@ func (d *Dict) parse(content []byte) error {
 		b := q[0]
 		q = q[1:]
 
-		rs.Roll(b)
+		c.Roll(b)
 		off++
-		d.totalBytesIn++
+		atomic.AddUint64(&d.totalBytesIn, 1)
 
 		buf = append(buf, b)
-		if rs.OnSplitWithBits(5) {
+		if c.OnSplit() {
 			h := sha1.Sum(buf)
 			offs = append(offs, off)
 			hashes = append(hashes, h[:])
@@ -125,7 +197,7 @@ func (d *Dict) parse(content []byte) error {
 		}
 	}
 
-	d.totalBytesDup += uint64(match)
+	atomic.AddUint64(&d.totalBytesDup, match)
 
 	if errStmt := stmt.Close(); errStmt != nil {
 		return err
@@ -144,15 +216,33 @@ func (d *Dict) parse(content []byte) error {
 }
 
 func (d *Dict) makeDict() error {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
 	contents, hashes, change := d.needToUpdate()
-	if change {
-		log.Println("Changing dict")
-		err := ioutil.WriteFile("dictraw", contents, 0644)
-		if err != nil {
-			return err
-		}
-		d.sdchDictChunks = hashes
+	if !change {
+		return nil
+	}
+
+	log.Println("Changing dict")
+	d.sdchDictChunks = hashes
+
+	header := d.buildHeader(contents)
+	id := dictId(header, contents)
+
+	if err := os.MkdirAll(filepath.Join(d.dir, "dicts"), 0755); err != nil {
+		return err
 	}
+	if err := ioutil.WriteFile(d.ContentPath(id), contents, 0644); err != nil {
+		return err
+	}
+
+	d.pushGeneration(&generation{
+		id:     id,
+		header: header,
+		enc:    vcdiff.NewEncoder(contents),
+	})
+
 	return nil
 }
 
@@ -207,7 +297,81 @@ func (d *Dict) needToUpdate() (contents []byte, hashes [][]byte, change bool) {
 }
 
 func (d *Dict) Stats() string {
-	return fmt.Sprintf("matched %d out of %d", d.totalBytesDup, d.totalBytesIn)
+	dup := atomic.LoadUint64(&d.totalBytesDup)
+	in := atomic.LoadUint64(&d.totalBytesIn)
+	return fmt.Sprintf("matched %d out of %d", dup, in)
+}
+
+// buildHeader renders the SDCH dictionary-description header (see the
+// SDCH draft, section "Dictionary format") that's served ahead of the
+// raw dictionary content at /_sdch/<name>.
+func (d *Dict) buildHeader(contents []byte) []byte {
+	path := d.scope.PathPrefix
+	if path == "" {
+		path = "/"
+	}
+	return []byte(fmt.Sprintf(
+		"Domain: %s\nPath: %s\nFormat-Version: 1.0\nMax-Age: 86400\n\n",
+		d.scope.Host, path,
+	))
+}
+
+// dictId derives the identifier SDCH uses both as the dictionary's
+// Server-Id/Client-Id and as its name under /_sdch/. It's the hash of the
+// header plus content, same as a client would compute after fetching it.
+func dictId(header, contents []byte) string {
+	sum := sha1.Sum(append(append([]byte{}, header...), contents...))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// DictName returns the identifier the current (newest) generation is
+// served under at /_sdch/<name>.
+func (d *Dict) DictName() string {
+	d.gensMu.RLock()
+	defer d.gensMu.RUnlock()
+	if len(d.gens) == 0 {
+		return ""
+	}
+	return d.gens[0].id
+}
+
+// CurrentHeader returns the SDCH dictionary-description header for the
+// current (newest) generation, or nil if no generation has been built
+// yet.
+func (d *Dict) CurrentHeader() []byte {
+	d.gensMu.RLock()
+	defer d.gensMu.RUnlock()
+	if len(d.gens) == 0 {
+		return nil
+	}
+	return d.gens[0].header
+}
+
+// Generation returns the header for the generation named id, regardless
+// of whether it's still the current one, so a client presenting an older
+// Avail-Dictionary can still be served its matching dictionary text.
+func (d *Dict) Generation(id string) (header []byte, ok bool) {
+	d.gensMu.RLock()
+	defer d.gensMu.RUnlock()
+	for _, g := range d.gens {
+		if g.id == id {
+			return g.header, true
+		}
+	}
+	return nil, false
+}
+
+// HasGeneration reports whether id names a generation we still serve.
+func (d *Dict) HasGeneration(id string) bool {
+	_, ok := d.Generation(id)
+	return ok
+}
+
+// ContentPath returns the on-disk location of generation id's raw
+// dictionary content (without its header), for servers that need to
+// stream a specific generation's content back to a client.
+func (d *Dict) ContentPath(id string) string {
+	return filepath.Join(d.dir, "dicts", id)
 }
 
 type sliceslice [][]byte
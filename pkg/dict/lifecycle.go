@@ -0,0 +1,137 @@
+package dict
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rakoo/mmas/pkg/dict/vcdiff"
+)
+
+const (
+	// maxGenerations is how many dictionary generations are kept on disk
+	// (and therefore how far back a client's Avail-Dictionary can lag
+	// before we stop being able to diff against it).
+	maxGenerations = 5
+
+	// defaultMaxChunkBytes bounds the sqlite chunks corpus per Dict
+	// before compact() starts evicting the least-seen chunks.
+	defaultMaxChunkBytes = 64 * 1024 * 1024
+
+	// defaultCompactInterval is how often the background compactor
+	// checks whether the corpus needs trimming.
+	defaultCompactInterval = 10 * time.Minute
+)
+
+// generation is one trained-and-published version of a Dict's
+// dictionary: a fixed piece of text served at /_sdch/<id>, plus the
+// encoder built against it.
+type generation struct {
+	id     string
+	header []byte
+	enc    *vcdiff.Encoder
+}
+
+// pushGeneration makes gen the current generation, keeping up to
+// maxGenerations on disk and removing the oldest one's content file once
+// that's exceeded.
+func (d *Dict) pushGeneration(gen *generation) {
+	d.gensMu.Lock()
+	d.gens = append([]*generation{gen}, d.gens...)
+
+	var evicted *generation
+	if len(d.gens) > maxGenerations {
+		evicted = d.gens[len(d.gens)-1]
+		d.gens = d.gens[:maxGenerations]
+	}
+	d.gensMu.Unlock()
+
+	if evicted == nil {
+		return
+	}
+	if err := os.Remove(d.ContentPath(evicted.id)); err != nil && !os.IsNotExist(err) {
+		log.Println("Error evicting old dictionary generation:", err)
+	}
+}
+
+// SetMaxChunkBytes changes the corpus size cap compact() enforces.
+func (d *Dict) SetMaxChunkBytes(n int64) {
+	atomic.StoreInt64(&d.maxChunkBytes, n)
+}
+
+// startCompactor runs compact on a timer for the lifetime of the Dict.
+func (d *Dict) startCompactor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := d.compact(); err != nil {
+				log.Println("Error compacting dict:", err)
+			}
+		}
+	}()
+}
+
+// compact evicts the lowest-count chunks from the sqlite corpus once its
+// total size exceeds maxChunkBytes, so a long-running proxy's chunk table
+// doesn't grow unboundedly. It takes compactMu so it can't race a
+// makeDict generation swap.
+func (d *Dict) compact() error {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	maxBytes := atomic.LoadInt64(&d.maxChunkBytes)
+
+	var total int64
+	if err := d.db.QueryRow(`SELECT COALESCE(SUM(LENGTH(content)), 0) FROM chunks`).Scan(&total); err != nil {
+		return err
+	}
+	if total <= maxBytes {
+		return nil
+	}
+
+	rows, err := d.db.Query(`SELECT hash, LENGTH(content) FROM chunks ORDER BY count ASC`)
+	if err != nil {
+		return err
+	}
+
+	// Collect the hashes to evict and close the read cursor before
+	// opening the delete transaction below: holding both open against
+	// the same sqlite file at once (an unfinished SELECT cursor alongside
+	// a write transaction) deadlocks the single-writer lock once the
+	// pool hands them different connections.
+	var toEvict [][]byte
+	var hash []byte
+	var size int64
+	for total > maxBytes && rows.Next() {
+		if err := rows.Scan(&hash, &size); err != nil {
+			break
+		}
+		toEvict = append(toEvict, append([]byte{}, hash...))
+		total -= size
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`DELETE FROM chunks WHERE hash = ?`)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range toEvict {
+		if _, err := stmt.Exec(h); err != nil {
+			break
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
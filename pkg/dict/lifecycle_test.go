@@ -0,0 +1,113 @@
+package dict
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestDict(t *testing.T) *Dict {
+	t.Helper()
+	d, err := New(t.TempDir(), Scope{Host: "example.com", PathPrefix: "/", ContentType: "text/html"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d
+}
+
+func touchGenerationFile(t *testing.T, d *Dict, id string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(d.dir, "dicts"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(d.ContentPath(id), []byte("content-"+id), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestPushGenerationEvictsOldest(t *testing.T) {
+	d := newTestDict(t)
+
+	ids := make([]string, 0, maxGenerations+2)
+	for i := 0; i < maxGenerations+2; i++ {
+		id := string(rune('a' + i))
+		ids = append(ids, id)
+		touchGenerationFile(t, d, id)
+		d.pushGeneration(&generation{id: id})
+	}
+
+	if len(d.gens) != maxGenerations {
+		t.Fatalf("len(d.gens) = %d, want %d", len(d.gens), maxGenerations)
+	}
+
+	// Newest first: the last maxGenerations ids pushed, most recent at
+	// index 0.
+	for i, g := range d.gens {
+		want := ids[len(ids)-1-i]
+		if g.id != want {
+			t.Fatalf("d.gens[%d].id = %q, want %q", i, g.id, want)
+		}
+	}
+
+	// The two oldest generations should have had their content files
+	// removed; the rest should still be on disk.
+	for i, id := range ids {
+		_, err := os.Stat(d.ContentPath(id))
+		stillExists := err == nil
+		wantExists := i >= len(ids)-maxGenerations
+		if stillExists != wantExists {
+			t.Errorf("generation %q on disk = %v, want %v", id, stillExists, wantExists)
+		}
+	}
+}
+
+func TestCompactEvictsLowestCountChunksFirst(t *testing.T) {
+	d := newTestDict(t)
+
+	// Insert three same-sized chunks with distinct counts, biggest count
+	// last so it's the one compact() must keep.
+	chunks := []struct {
+		content string
+		count   int
+	}{
+		{"aaaaaaaaaa", 1}, // 10 bytes, count 1 (evict first)
+		{"bbbbbbbbbb", 2}, // 10 bytes, count 2
+		{"cccccccccc", 5}, // 10 bytes, count 5 (keep)
+	}
+	for _, c := range chunks {
+		hash := []byte(c.content[:4])
+		if _, err := d.db.Exec(
+			`INSERT INTO chunks (content, hash, count) VALUES (?, ?, ?)`,
+			[]byte(c.content), hash, c.count,
+		); err != nil {
+			t.Fatalf("inserting chunk: %v", err)
+		}
+	}
+
+	// Only room for one 10-byte chunk.
+	d.SetMaxChunkBytes(15)
+
+	if err := d.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	rows, err := d.db.Query(`SELECT content, count FROM chunks`)
+	if err != nil {
+		t.Fatalf("querying remaining chunks: %v", err)
+	}
+	defer rows.Close()
+
+	var remaining []string
+	for rows.Next() {
+		var content []byte
+		var count int
+		if err := rows.Scan(&content, &count); err != nil {
+			t.Fatalf("scanning row: %v", err)
+		}
+		remaining = append(remaining, string(content))
+	}
+
+	if len(remaining) != 1 || remaining[0] != "cccccccccc" {
+		t.Fatalf("remaining chunks = %v, want only the highest-count one", remaining)
+	}
+}
@@ -0,0 +1,145 @@
+package dict
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Scope identifies one dictionary corpus. MMAS trains a separate
+// dictionary per (host, path prefix, content type), since e.g. news
+// articles and product pages on the same site produce very different
+// chunks and shouldn't be crammed into one corpus.
+type Scope struct {
+	Host        string
+	PathPrefix  string
+	ContentType string
+}
+
+// key returns a filesystem- and map-safe identifier for the scope.
+func (s Scope) key() string {
+	sum := sha1.Sum([]byte(s.Host + "\x00" + s.PathPrefix + "\x00" + s.ContentType))
+	return hex.EncodeToString(sum[:])
+}
+
+// DictStore holds one *Dict per Scope, creating them lazily on first use.
+// It replaces the single global "dict"/"dictraw" pair the proxy used to
+// assume, so MMAS can front more than one site.
+type DictStore struct {
+	baseDir string
+
+	mu    sync.RWMutex
+	dicts map[string]*Dict
+}
+
+// NewStore creates a DictStore that keeps each scope's sqlite database
+// and dictionary files under its own subdirectory of baseDir.
+func NewStore(baseDir string) *DictStore {
+	return &DictStore{
+		baseDir: baseDir,
+		dicts:   make(map[string]*Dict),
+	}
+}
+
+// Get returns the Dict for scope, creating it (and its on-disk directory)
+// if this is the first time the scope has been seen.
+func (s *DictStore) Get(scope Scope) (*Dict, error) {
+	key := scope.key()
+
+	s.mu.RLock()
+	d, ok := s.dicts[key]
+	s.mu.RUnlock()
+	if ok {
+		return d, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.dicts[key]; ok {
+		return d, nil
+	}
+
+	dir := filepath.Join(s.baseDir, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("dict: creating scope dir: %v", err)
+	}
+
+	d, err := New(dir, scope)
+	if err != nil {
+		return nil, err
+	}
+	s.dicts[key] = d
+	return d, nil
+}
+
+// Lookup finds the Dict that best matches an inbound request: the host
+// must match exactly, and among the scopes registered for that host the
+// longest path prefix covering reqPath wins, preferring an exact
+// content-type match over the empty (wildcard) one. It returns false if
+// no scope registered for host covers reqPath and contentType; the Dict
+// it does return may not have built any generation yet.
+func (s *DictStore) Lookup(host, reqPath, contentType string) (*Dict, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var best *Dict
+	var bestScope Scope
+	for _, d := range s.dicts {
+		sc := d.scope
+		if sc.Host != host {
+			continue
+		}
+		if !pathHasPrefix(reqPath, sc.PathPrefix) {
+			continue
+		}
+		if sc.ContentType != "" && sc.ContentType != contentType {
+			continue
+		}
+		if best == nil || moreSpecific(sc, bestScope) {
+			best = d
+			bestScope = sc
+		}
+	}
+	return best, best != nil
+}
+
+// ByName returns the Dict serving generation name, regardless of whether
+// that's still its current generation; used to serve a dictionary back to
+// a client that already knows its id.
+func (s *DictStore) ByName(name string) (*Dict, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, d := range s.dicts {
+		if d.HasGeneration(name) {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// pathHasPrefix reports whether reqPath falls under prefix as a path
+// segment, not merely a string prefix: prefix "/news" matches "/news" and
+// "/news/1" but not "/newsroom", since that's a different section that
+// just happens to share the same leading characters. A prefix that
+// already ends in "/" (e.g. "/wiki/") covers every path beneath it.
+func pathHasPrefix(reqPath, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if len(reqPath) < len(prefix) || reqPath[:len(prefix)] != prefix {
+		return false
+	}
+	return len(reqPath) == len(prefix) || prefix[len(prefix)-1] == '/' || reqPath[len(prefix)] == '/'
+}
+
+func moreSpecific(a, b Scope) bool {
+	if len(a.PathPrefix) != len(b.PathPrefix) {
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	}
+	return a.ContentType != "" && b.ContentType == ""
+}
@@ -0,0 +1,104 @@
+package dict
+
+import (
+	"testing"
+)
+
+func TestScopeKeyDistinguishesFields(t *testing.T) {
+	a := Scope{Host: "example.com", PathPrefix: "/news", ContentType: "text/html"}
+	b := Scope{Host: "example.com", PathPrefix: "/news", ContentType: "application/json"}
+	c := Scope{Host: "example.com", PathPrefix: "/shop", ContentType: "text/html"}
+
+	if a.key() == b.key() || a.key() == c.key() || b.key() == c.key() {
+		t.Fatalf("expected distinct scopes to have distinct keys: %q %q %q", a.key(), b.key(), c.key())
+	}
+	if a.key() != (Scope{Host: "example.com", PathPrefix: "/news", ContentType: "text/html"}).key() {
+		t.Fatalf("expected identical scopes to produce the same key")
+	}
+}
+
+func TestDictStoreGetIsIdempotent(t *testing.T) {
+	store := NewStore(t.TempDir())
+	scope := Scope{Host: "example.com", PathPrefix: "/", ContentType: "text/html"}
+
+	d1, err := store.Get(scope)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	d2, err := store.Get(scope)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if d1 != d2 {
+		t.Fatalf("Get returned a different *Dict for the same scope")
+	}
+}
+
+func TestDictStoreLookup(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	scopes := []Scope{
+		{Host: "example.com", PathPrefix: "/", ContentType: ""},
+		{Host: "example.com", PathPrefix: "/news", ContentType: ""},
+		{Host: "example.com", PathPrefix: "/news", ContentType: "application/json"},
+		{Host: "other.com", PathPrefix: "/", ContentType: ""},
+	}
+	dicts := make(map[Scope]*Dict, len(scopes))
+	for _, sc := range scopes {
+		d, err := store.Get(sc)
+		if err != nil {
+			t.Fatalf("Get(%+v): %v", sc, err)
+		}
+		dicts[sc] = d
+	}
+
+	tests := []struct {
+		name        string
+		host        string
+		reqPath     string
+		contentType string
+		want        Scope
+		wantOK      bool
+	}{
+		{"falls back to the host-wide scope", "example.com", "/about", "text/html", scopes[0], true},
+		{"longest path prefix wins", "example.com", "/news/article-1", "text/html", scopes[1], true},
+		{"exact content-type beats the wildcard at the same prefix", "example.com", "/news/article-1", "application/json", scopes[2], true},
+		{"unknown host", "unknown.com", "/", "text/html", Scope{}, false},
+		{"host matches but nothing was ever trained", "other.com", "/elsewhere", "text/html", scopes[3], true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := store.Lookup(tt.host, tt.reqPath, tt.contentType)
+			if ok != tt.wantOK {
+				t.Fatalf("Lookup(%q, %q, %q) ok = %v, want %v", tt.host, tt.reqPath, tt.contentType, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if want := dicts[tt.want]; got != want {
+				t.Fatalf("Lookup(%q, %q, %q) returned the wrong Dict", tt.host, tt.reqPath, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestPathHasPrefix(t *testing.T) {
+	tests := []struct {
+		reqPath, prefix string
+		want            bool
+	}{
+		{"/anything", "", true},
+		{"/anything", "/", true},
+		{"/news", "/news", true},
+		{"/news/1", "/news", true},
+		{"/newsroom", "/news", false},
+		{"/shop", "/news", false},
+		{"/new", "/news", false},
+	}
+	for _, tt := range tests {
+		if got := pathHasPrefix(tt.reqPath, tt.prefix); got != tt.want {
+			t.Errorf("pathHasPrefix(%q, %q) = %v, want %v", tt.reqPath, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package vcdiff
+
+import "io"
+
+// writeVarint writes v using VCDIFF's variable-length integer encoding
+// (RFC 3284 section 2): base-128, most-significant byte first, with the
+// continuation bit (0x80) set on every byte but the last.
+func writeVarint(w io.Writer, v uint64) error {
+	var buf [10]byte
+	n := len(buf)
+
+	n--
+	buf[n] = byte(v & 0x7f)
+	v >>= 7
+	for v > 0 {
+		n--
+		buf[n] = byte(v&0x7f) | 0x80
+		v >>= 7
+	}
+
+	_, err := w.Write(buf[n:])
+	return err
+}
+
+func writeByte(w io.Writer, b byte) error {
+	_, err := w.Write([]byte{b})
+	return err
+}
@@ -0,0 +1,442 @@
+// Package vcdiff implements a subset of RFC 3284 (VCDIFF), enough to
+// produce SDCH-compatible delta-encoded responses without shelling out to
+// the external `vcdiff` binary. It only implements encoding (diffing
+// against a dictionary), since that's the only direction MMAS needs: the
+// browser does the decoding.
+//
+// The output uses the "interleaved" layout (as produced by `vcdiff delta
+// -interleaved`): instructions, their sizes/addresses and their literal
+// data all live in a single section instead of the three separate
+// sections RFC 3284 describes, which is what lets a decoder apply the
+// delta in one streaming pass.
+//
+// It declares and uses its own code table (RFC 3284 section 4.5) rather
+// than the RFC default one: our instruction stream only ever needs plain
+// ADD/RUN/COPY with the size read from the stream and, for COPY, an
+// explicit absolute address, so a three-row table covers it with no
+// address-cache bookkeeping.
+package vcdiff
+
+import (
+	"bytes"
+	"hash/adler32"
+	"io"
+)
+
+const (
+	// minMatchLen is the shortest copy we bother emitting; anything
+	// shorter costs more in instruction overhead than it saves.
+	minMatchLen = 8
+
+	// windowLen is the size of the rolling window used to key the match
+	// index. It must be <= minMatchLen.
+	windowLen = 8
+
+	// minRunLen is the shortest run of a single repeated byte we encode
+	// as a RUN instruction instead of literal ADD bytes.
+	minRunLen = 8
+
+	// maxChainLen bounds how many candidate positions we'll walk per
+	// hash bucket, so a pathologically repetitive dictionary can't turn
+	// match finding quadratic.
+	maxChainLen = 64
+)
+
+// VCDIFF magic header: byte0-2 identify the format, byte3 is the version.
+var magic = []byte{0xd6, 0xc3, 0xc4, 0x00}
+
+// Hdr_Indicator bits (RFC 3284 section 4.1).
+const (
+	vcdDecompress = 0x01
+	vcdCodeTable  = 0x02
+)
+
+// Window indicator bits (RFC 3284 section 4.2, plus the open-vcdiff
+// VCD_ADLER32 extension SDCH relies on for integrity checking).
+const (
+	vcdSource  = 0x01
+	vcdAdler32 = 0x04
+)
+
+// Instruction type values (RFC 3284 section 5.1): these double as both the
+// instruction-stream op byte and the code-table row index in our table,
+// since every row we define holds exactly one instruction of that type
+// (paired with NOOP) and its size is always drawn from the stream rather
+// than baked into the row. Code 0 is reserved (RFC reserves it for the
+// all-NOOP row) and never appears in our stream.
+const (
+	instNoop = 0
+	instAdd  = 1
+	instRun  = 2
+	instCopy = 3
+)
+
+// codeTableData is our custom VCD_CODETABLE payload: a varint length
+// followed by the Near/Same cache-size bytes and the six 256-entry arrays
+// (inst1, size1, mode1, inst2, size2, mode2) RFC 3284 section 4.5 uses to
+// describe an application-defined code table. We declare it instead of
+// claiming Hdr_Indicator's default-table bit, because our instruction
+// stream doesn't use the RFC default table's layout: every row we use has
+// size1=0 (read the size from the stream) and mode1=0 (VCD_SELF, an
+// explicit absolute address) with Near=Same=0, since we never exercise the
+// HERE/NEAR/SAME copy-address caches.
+var codeTableData = buildCodeTableData()
+
+func buildCodeTableData() []byte {
+	var inst1, inst2 [256]byte
+	inst1[instAdd] = instAdd
+	inst1[instRun] = instRun
+	inst1[instCopy] = instCopy
+	// size1, mode1, size2, mode2 all stay zero-valued; inst2 stays NOOP
+	// (0) everywhere, including the rows we use.
+
+	var table bytes.Buffer
+	table.WriteByte(0) // Near: no near-address caches
+	table.WriteByte(0) // Same: no same-address caches
+	table.Write(inst1[:])
+	table.Write(make([]byte, 256)) // size1
+	table.Write(make([]byte, 256)) // mode1
+	table.Write(inst2[:])
+	table.Write(make([]byte, 256)) // size2
+	table.Write(make([]byte, 256)) // mode2
+
+	var out bytes.Buffer
+	writeVarint(&out, uint64(table.Len()))
+	out.Write(table.Bytes())
+	return out.Bytes()
+}
+
+// Encoder diffs target content against a fixed dictionary, producing a
+// VCDIFF delta. It keeps a hash index over the dictionary so repeated
+// calls to Encode don't re-scan it from scratch.
+type Encoder struct {
+	dict  []byte
+	index *matchIndex
+}
+
+// NewEncoder builds an Encoder over dictionary. The dictionary is indexed
+// once up front; Encode can then be called many times against it.
+func NewEncoder(dictionary []byte) *Encoder {
+	return &Encoder{
+		dict:  dictionary,
+		index: buildMatchIndex(dictionary),
+	}
+}
+
+// Encode produces a complete, standalone VCDIFF delta that reconstructs
+// target when applied against the dictionary Encoder was built with.
+func (e *Encoder) Encode(target []byte) ([]byte, error) {
+	var out bytes.Buffer
+	if err := e.encodeTo(&out, target); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (e *Encoder) encodeTo(w io.Writer, target []byte) error {
+	if _, err := w.Write(magic); err != nil {
+		return err
+	}
+	// Hdr_Indicator: no secondary compressor, custom code table follows.
+	if err := writeByte(w, vcdCodeTable); err != nil {
+		return err
+	}
+	if _, err := w.Write(codeTableData); err != nil {
+		return err
+	}
+
+	instructions := e.encodeInstructions(target)
+
+	winIndicator := byte(vcdSource | vcdAdler32)
+	if err := writeByte(w, winIndicator); err != nil {
+		return err
+	}
+	// Source segment: the whole dictionary, starting at offset 0.
+	if err := writeVarint(w, uint64(len(e.dict))); err != nil {
+		return err
+	}
+	if err := writeVarint(w, 0); err != nil {
+		return err
+	}
+
+	checksum := adler32.Checksum(target)
+
+	// Length of the delta encoding that follows the length byte itself:
+	// target window length + delta indicator + the three interleaved
+	// section lengths + checksum + the instruction bytes.
+	var lenBuf bytes.Buffer
+	writeVarint(&lenBuf, uint64(len(target)))
+	lenBuf.WriteByte(0x00)                          // Delta_Indicator: no secondary compression
+	writeVarint(&lenBuf, 0)                         // data section length (merged into instructions)
+	writeVarint(&lenBuf, uint64(len(instructions))) // instructions+sizes section length
+	writeVarint(&lenBuf, 0)                         // addresses section length (merged into instructions)
+	writeVarint(&lenBuf, uint64(checksum))
+
+	if err := writeVarint(w, uint64(lenBuf.Len()+len(instructions))); err != nil {
+		return err
+	}
+	if _, err := w.Write(lenBuf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(instructions)
+	return err
+}
+
+// encodeInstructions walks target greedily: a run of at least minRunLen
+// repeated bytes becomes a RUN; otherwise it takes the longest copy it
+// can find (from the dictionary or from target content already
+// emitted), falling back to literal adds.
+func (e *Encoder) encodeInstructions(target []byte) []byte {
+	var out bytes.Buffer
+	selfIndex := make(map[uint64][]int32)
+
+	var literal []byte
+	flushLiteral := func() {
+		if len(literal) == 0 {
+			return
+		}
+		writeByte(&out, instAdd)
+		writeVarint(&out, uint64(len(literal)))
+		out.Write(literal)
+		literal = literal[:0]
+	}
+
+	i := 0
+	for i < len(target) {
+		if n := runLength(target, i); n >= minRunLen {
+			flushLiteral()
+			writeByte(&out, instRun)
+			writeVarint(&out, uint64(n))
+			out.WriteByte(target[i])
+			i += n
+			continue
+		}
+
+		length, addr, found := e.bestMatch(target, i, selfIndex)
+		if found {
+			flushLiteral()
+			writeByte(&out, instCopy)
+			writeVarint(&out, uint64(length))
+			writeVarint(&out, uint64(addr))
+			e.indexTargetRange(selfIndex, target, i, i+length)
+			i += length
+			continue
+		}
+
+		if i+windowLen <= len(target) {
+			// Index only position i itself here, not the whole
+			// window ahead of it: indexing i+1..i+windowLen-1 now
+			// would let a match a few bytes from now resolve to a
+			// source position that's still in its own future,
+			// which no decoder can satisfy (it hasn't written
+			// that target content yet).
+			e.indexTargetRange(selfIndex, target, i, i+1)
+		}
+		literal = append(literal, target[i])
+		i++
+	}
+	flushLiteral()
+
+	return out.Bytes()
+}
+
+// matchIndex is a flat, GC-friendly replacement for a map[uint64][]int32
+// keyed by window hash. A dictionary can be tens of megabytes, meaning
+// tens of millions of indexed windows; a Go map with one entry (and one
+// small backing slice) per distinct hash turns indexing into a
+// superlinear GC-pressure problem at that size. Instead the whole index
+// is built in two passes into a pair of flat arrays: an open-addressed
+// hash table mapping a window hash to a run within positions, and
+// positions itself holding every indexed offset contiguously, grouped by
+// hash (a CSR layout).
+type matchIndex struct {
+	table []indexSlot
+	mask  uint64
+	pos   []int32
+}
+
+type indexSlot struct {
+	key   uint64
+	used  bool
+	start int32
+	count int32
+}
+
+// buildMatchIndex indexes every windowLen-byte window of buf, capping
+// each hash's chain at maxChainLen occurrences (the earliest ones seen),
+// matching the chain length limit indexTargetRange enforces on the
+// map-based index of target positions.
+func buildMatchIndex(buf []byte) *matchIndex {
+	n := len(buf) - windowLen + 1
+	if n <= 0 {
+		return &matchIndex{}
+	}
+
+	hashes := make([]uint64, n)
+	for i := range hashes {
+		hashes[i] = hashWindow(buf[i : i+windowLen])
+	}
+
+	tableSize := 1
+	for tableSize < 2*n {
+		tableSize <<= 1
+	}
+	mi := &matchIndex{
+		table: make([]indexSlot, tableSize),
+		mask:  uint64(tableSize - 1),
+	}
+
+	// Pass 1: claim a slot per distinct key and count its (capped)
+	// occurrences, so we know how much of positions each key needs.
+	for _, h := range hashes {
+		s := &mi.table[mi.slotFor(h)]
+		if !s.used {
+			s.used = true
+			s.key = h
+		}
+		if s.count < maxChainLen {
+			s.count++
+		}
+	}
+
+	// Prefix-sum the per-slot counts into offsets within positions.
+	var total int32
+	for i := range mi.table {
+		if mi.table[i].used {
+			mi.table[i].start = total
+			total += mi.table[i].count
+		}
+	}
+	mi.pos = make([]int32, total)
+
+	// Pass 2: fill positions, using a write cursor per slot so each
+	// key's occurrences land in its own reserved run; cursor stops
+	// advancing once a slot hits its capped count, so later duplicate
+	// occurrences of a hash beyond maxChainLen are skipped, same as pass
+	// 1's cap.
+	cursor := make([]int32, tableSize)
+	for i, s := range mi.table {
+		if s.used {
+			cursor[i] = s.start
+		}
+	}
+	for i, h := range hashes {
+		idx := mi.slotFor(h)
+		s := mi.table[idx]
+		if cursor[idx] < s.start+s.count {
+			mi.pos[cursor[idx]] = int32(i)
+			cursor[idx]++
+		}
+	}
+
+	return mi
+}
+
+// slotFor returns the table index holding key, or the empty slot it
+// should occupy if key hasn't been inserted yet (open addressing with
+// linear probing; the table is sized for a <=0.5 load factor so probes
+// stay short).
+func (mi *matchIndex) slotFor(key uint64) uint64 {
+	idx := key & mi.mask
+	for {
+		s := &mi.table[idx]
+		if !s.used || s.key == key {
+			return idx
+		}
+		idx = (idx + 1) & mi.mask
+	}
+}
+
+// lookup returns the positions indexed under key, or nil if key was
+// never seen.
+func (mi *matchIndex) lookup(key uint64) []int32 {
+	if len(mi.table) == 0 {
+		return nil
+	}
+	idx := mi.slotFor(key)
+	s := mi.table[idx]
+	if !s.used {
+		return nil
+	}
+	return mi.pos[s.start : s.start+s.count]
+}
+
+// bestMatch looks for the longest run of bytes starting at target[pos:]
+// that also occurs either in the dictionary or in target[:pos] (the part
+// already encoded), which VCDIFF addresses as one contiguous space:
+// 0..len(dict)-1 is the dictionary, len(dict)..len(dict)+pos-1 is target
+// output emitted so far.
+func (e *Encoder) bestMatch(target []byte, pos int, selfIndex map[uint64][]int32) (length, addr int, found bool) {
+	if pos+windowLen > len(target) {
+		return 0, 0, false
+	}
+	key := hashWindow(target[pos : pos+windowLen])
+
+	best := 0
+	bestAddr := 0
+
+	tryCandidates := func(candidates []int32, base []byte, addrBase int) {
+		tried := 0
+		for _, c := range candidates {
+			if tried >= maxChainLen {
+				break
+			}
+			tried++
+			l := matchLength(base[c:], target[pos:])
+			if l > best {
+				best = l
+				bestAddr = addrBase + int(c)
+			}
+		}
+	}
+
+	tryCandidates(e.index.lookup(key), e.dict, 0)
+	tryCandidates(selfIndex[key], target, len(e.dict))
+
+	if best < minMatchLen {
+		return 0, 0, false
+	}
+	return best, bestAddr, true
+}
+
+func (e *Encoder) indexTargetRange(selfIndex map[uint64][]int32, target []byte, from, to int) {
+	for i := from; i < to && i+windowLen <= len(target); i++ {
+		h := hashWindow(target[i : i+windowLen])
+		chain := selfIndex[h]
+		if len(chain) < maxChainLen {
+			selfIndex[h] = append(chain, int32(i))
+		}
+	}
+}
+
+func matchLength(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func runLength(buf []byte, pos int) int {
+	n := 1
+	for pos+n < len(buf) && buf[pos+n] == buf[pos] {
+		n++
+	}
+	return n
+}
+
+// hashWindow computes a cheap rolling-style hash of a fixed-size byte
+// window for use as a match-index key. It doesn't need to be incremental
+// since windows are only ever hashed once per position.
+func hashWindow(b []byte) uint64 {
+	var h uint64 = 1469598103934665603 // FNV-1a offset basis
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= 1099511628211 // FNV-1a prime
+	}
+	return h
+}
@@ -0,0 +1,413 @@
+package vcdiff
+
+import (
+	"bytes"
+	"fmt"
+	"hash/adler32"
+	"math/rand"
+	"testing"
+)
+
+// The production code never decodes (that's the browser's job, per the
+// package doc comment), so this is a standalone reference decoder used
+// only to prove Encode's output is actually well-formed VCDIFF: it parses
+// the custom code table we declare rather than assuming our own
+// instAdd/instRun/instCopy constants, so a bug in how encodeTo wires up
+// Hdr_Indicator or codeTableData would show up here as a parse failure,
+// not just a round-trip mismatch.
+
+type reader struct {
+	b   []byte
+	pos int
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.pos >= len(r.b) {
+		return 0, fmt.Errorf("vcdiff: unexpected end of input")
+	}
+	b := r.b[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *reader) take(n int) ([]byte, error) {
+	if r.pos+n > len(r.b) {
+		return nil, fmt.Errorf("vcdiff: unexpected end of input")
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) varint() (uint64, error) {
+	var v uint64
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+}
+
+// codeRow is one row of a VCDIFF code table (RFC 3284 section 4.5).
+type codeRow struct {
+	inst1, size1, mode1 byte
+	inst2, size2, mode2 byte
+}
+
+// decode applies a VCDIFF delta produced by Encode against dictionary,
+// returning the reconstructed target. It only supports what our Encoder
+// ever emits: VCD_SOURCE windows, a single custom code table, and mode 0
+// (VCD_SELF) addresses -- it is not a general-purpose VCDIFF decoder.
+func decode(delta, dictionary []byte) ([]byte, error) {
+	r := &reader{b: delta}
+
+	gotMagic, err := r.take(4)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(gotMagic, magic) {
+		return nil, fmt.Errorf("vcdiff: bad magic %x", gotMagic)
+	}
+
+	hdrIndicator, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if hdrIndicator&vcdDecompress != 0 {
+		return nil, fmt.Errorf("vcdiff: secondary compressors not supported")
+	}
+
+	table, err := defaultTable(hdrIndicator, r)
+	if err != nil {
+		return nil, err
+	}
+
+	winIndicator, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if winIndicator&vcdSource == 0 {
+		return nil, fmt.Errorf("vcdiff: only VCD_SOURCE windows are supported")
+	}
+
+	srcLen, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	srcPos, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if srcPos != 0 || int(srcLen) != len(dictionary) {
+		return nil, fmt.Errorf("vcdiff: unexpected source segment [%d,%d)", srcPos, srcLen)
+	}
+
+	if _, err := r.varint(); err != nil { // delta window length
+		return nil, err
+	}
+	targetLen, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	deltaIndicator, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if deltaIndicator != 0 {
+		return nil, fmt.Errorf("vcdiff: secondary-compressed sections not supported")
+	}
+	dataLen, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	instLen, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	addrLen, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if dataLen != 0 || addrLen != 0 {
+		return nil, fmt.Errorf("vcdiff: only the interleaved layout is supported")
+	}
+	wantChecksum, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+
+	instructions, err := r.take(int(instLen))
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := applyInstructions(table, dictionary, instructions, int(targetLen))
+	if err != nil {
+		return nil, err
+	}
+
+	if got := uint64(adler32.Checksum(target)); got != wantChecksum {
+		return nil, fmt.Errorf("vcdiff: checksum mismatch: got %d, want %d", got, wantChecksum)
+	}
+	return target, nil
+}
+
+// defaultTable reads the custom code table our Encoder always declares.
+// Real decoders would fall back to the RFC 3284 default table when
+// Hdr_Indicator's VCD_CODETABLE bit is clear; we don't need that path
+// since we always set it.
+func defaultTable(hdrIndicator byte, r *reader) ([256]codeRow, error) {
+	var table [256]codeRow
+	if hdrIndicator&vcdCodeTable == 0 {
+		return table, fmt.Errorf("vcdiff: expected a custom code table")
+	}
+
+	tableLen, err := r.varint()
+	if err != nil {
+		return table, err
+	}
+	data, err := r.take(int(tableLen))
+	if err != nil {
+		return table, err
+	}
+	tr := &reader{b: data}
+
+	near, err := tr.byte()
+	if err != nil {
+		return table, err
+	}
+	same, err := tr.byte()
+	if err != nil {
+		return table, err
+	}
+	if near != 0 || same != 0 {
+		return table, fmt.Errorf("vcdiff: near/same address caches not supported")
+	}
+
+	arrays := make([][256]byte, 6)
+	for i := range arrays {
+		col, err := tr.take(256)
+		if err != nil {
+			return table, err
+		}
+		copy(arrays[i][:], col)
+	}
+	for code := range table {
+		table[code] = codeRow{
+			inst1: arrays[0][code], size1: arrays[1][code], mode1: arrays[2][code],
+			inst2: arrays[3][code], size2: arrays[4][code], mode2: arrays[5][code],
+		}
+	}
+	return table, nil
+}
+
+// applyInstructions walks the interleaved instruction stream, applying
+// each instruction against the combined dictionary+target-so-far address
+// space (RFC 3284 section 5.3).
+func applyInstructions(table [256]codeRow, dictionary, instructions []byte, targetLen int) ([]byte, error) {
+	out := make([]byte, 0, targetLen)
+	r := &reader{b: instructions}
+
+	apply := func(inst, size, mode byte) error {
+		switch inst {
+		case instNoop:
+			return nil
+		case instAdd:
+			n, err := instSize(r, size)
+			if err != nil {
+				return err
+			}
+			lit, err := r.take(n)
+			if err != nil {
+				return err
+			}
+			out = append(out, lit...)
+			return nil
+		case instRun:
+			n, err := instSize(r, size)
+			if err != nil {
+				return err
+			}
+			b, err := r.byte()
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				out = append(out, b)
+			}
+			return nil
+		case instCopy:
+			n, err := instSize(r, size)
+			if err != nil {
+				return err
+			}
+			if mode != 0 {
+				return fmt.Errorf("vcdiff: copy mode %d not supported", mode)
+			}
+			addr, err := r.varint()
+			if err != nil {
+				return err
+			}
+			return applyCopy(&out, dictionary, int(addr), n)
+		default:
+			return fmt.Errorf("vcdiff: unknown instruction type %d", inst)
+		}
+	}
+
+	for r.pos < len(instructions) {
+		code, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		row := table[code]
+		if err := apply(row.inst1, row.size1, row.mode1); err != nil {
+			return nil, err
+		}
+		if err := apply(row.inst2, row.size2, row.mode2); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func instSize(r *reader, size byte) (int, error) {
+	if size != 0 {
+		return int(size), nil
+	}
+	v, err := r.varint()
+	if err != nil {
+		return 0, err
+	}
+	return int(v), nil
+}
+
+// applyCopy copies n bytes starting at addr in the combined
+// dictionary+target-so-far address space into out, byte by byte so that
+// a copy overlapping the bytes it's in the middle of writing (addr falls
+// within the part of out this very instruction has already appended)
+// still reproduces VCDIFF's "copy from data written so far" semantics.
+func applyCopy(out *[]byte, dictionary []byte, addr, n int) error {
+	for i := 0; i < n; i++ {
+		pos := addr + i
+		var b byte
+		switch {
+		case pos < len(dictionary):
+			b = dictionary[pos]
+		case pos-len(dictionary) < len(*out):
+			b = (*out)[pos-len(dictionary)]
+		default:
+			return fmt.Errorf("vcdiff: copy address %d out of range", pos)
+		}
+		*out = append(*out, b)
+	}
+	return nil
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		dict string
+		in   string
+	}{
+		{"empty target", "the quick brown fox jumps over the lazy dog", ""},
+		{"no overlap with dictionary", "abcdefgh", "xyz1234567890!!"},
+		{"entirely from dictionary", "the quick brown fox jumps over the lazy dog", "the quick brown fox jumps over the lazy dog"},
+		{"run of repeated bytes", "abcdefgh", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		{"mix of copy, add and run", "<html><head><title>Example</title></head><body>",
+			"<html><head><title>Different</title></head><body>ccccccccccc<footer>new</footer>"},
+		{"self-referential copy", "x", "abcabcabcabcabcabcabcabcabcabcabc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := NewEncoder([]byte(tt.dict))
+			delta, err := enc.Encode([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+
+			got, err := decode(delta, []byte(tt.dict))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if string(got) != tt.in {
+				t.Fatalf("round-trip mismatch: got %q, want %q", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestEncodeDeclaresCustomCodeTable(t *testing.T) {
+	enc := NewEncoder([]byte("dictionary content"))
+	delta, err := enc.Encode([]byte("some target content"))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	hdrIndicator := delta[len(magic)]
+	if hdrIndicator&vcdCodeTable == 0 {
+		t.Fatalf("Hdr_Indicator = %#x, want VCD_CODETABLE (%#x) set", hdrIndicator, vcdCodeTable)
+	}
+}
+
+func TestMatchIndexLookup(t *testing.T) {
+	// A run of 10 a's has 3 distinct start positions (0, 1, 2) whose
+	// windowLen-byte window is all-'a'; the trailing b's give one
+	// all-'b' window, at 10.
+	buf := []byte("aaaaaaaaaabbbbbbbb")
+	mi := buildMatchIndex(buf)
+
+	got := mi.lookup(hashWindow(buf[0:windowLen]))
+	want := []int32{0, 1, 2}
+	if len(got) != len(want) {
+		t.Fatalf("lookup(a...) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("lookup(a...) = %v, want %v", got, want)
+		}
+	}
+
+	got = mi.lookup(hashWindow(buf[10 : 10+windowLen]))
+	if len(got) != 1 || got[0] != 10 {
+		t.Fatalf("lookup(b...) = %v, want [10]", got)
+	}
+
+	if got := mi.lookup(hashWindow([]byte("not-in-buf!!"))); got != nil {
+		t.Fatalf("lookup(unseen key) = %v, want nil", got)
+	}
+}
+
+func TestMatchIndexCapsChainAtEarliestOccurrences(t *testing.T) {
+	// Every windowLen-byte window of an all-'a' buffer hashes the same,
+	// so this exercises the maxChainLen cap directly.
+	buf := bytes.Repeat([]byte("a"), maxChainLen+50)
+	mi := buildMatchIndex(buf)
+
+	got := mi.lookup(hashWindow(buf[0:windowLen]))
+	if len(got) != maxChainLen {
+		t.Fatalf("len(lookup) = %d, want maxChainLen (%d)", len(got), maxChainLen)
+	}
+	for i, pos := range got {
+		if pos != int32(i) {
+			t.Fatalf("lookup()[%d] = %d, want the earliest occurrences (0..%d)", i, pos, maxChainLen-1)
+		}
+	}
+}
+
+func BenchmarkNewEncoder(b *testing.B) {
+	dict := make([]byte, 1<<20)
+	if _, err := rand.Read(dict); err != nil {
+		b.Fatalf("rand.Read: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewEncoder(dict)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec knows how to decode and encode a single HTTP content-coding, as
+// named in the Content-Encoding / Accept-Encoding headers (e.g. "gzip",
+// "br", "zstd").
+type Codec interface {
+	Name() string
+	Decode(r io.Reader) ([]byte, error)
+	Encode(w io.Writer, p []byte) error
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Decode(r io.Reader) ([]byte, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	return ioutil.ReadAll(gzr)
+}
+
+func (gzipCodec) Encode(w io.Writer, p []byte) error {
+	gzw := gzip.NewWriter(w)
+	if _, err := gzw.Write(p); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+type brotliCodec struct{}
+
+func (brotliCodec) Name() string { return "br" }
+
+func (brotliCodec) Decode(r io.Reader) ([]byte, error) {
+	return ioutil.ReadAll(brotli.NewReader(r))
+}
+
+func (brotliCodec) Encode(w io.Writer, p []byte) error {
+	bw := brotli.NewWriter(w)
+	if _, err := bw.Write(p); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) Decode(r io.Reader) ([]byte, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+func (zstdCodec) Encode(w io.Writer, p []byte) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(p); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// codecs is the set of content-codings we know how to speak, keyed by the
+// name used in Content-Encoding / Accept-Encoding.
+var codecs = map[string]Codec{
+	"gzip": gzipCodec{},
+	"br":   brotliCodec{},
+	"zstd": zstdCodec{},
+}
+
+// decodeContent walks the Content-Encoding chain (outermost first, as HTTP
+// specifies) and undoes every coding we recognize, returning the plain
+// content underneath. Like Accept-Encoding, Content-Encoding can list
+// several codings either as separate header lines or comma-joined in one
+// ("gzip, br"), so each element of ces is split on commas before lookup.
+func decodeContent(ces []string, body []byte) ([]byte, error) {
+	var codings []string
+	for _, ce := range ces {
+		for _, c := range strings.Split(ce, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				codings = append(codings, c)
+			}
+		}
+	}
+
+	content := body
+	for i := len(codings) - 1; i >= 0; i-- {
+		codec, ok := codecs[codings[i]]
+		if !ok {
+			continue
+		}
+		decoded, err := codec.Decode(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		content = decoded
+	}
+	return content, nil
+}
+
+// acceptedCodec picks the best Codec advertised by the client's
+// Accept-Encoding header(s), according to q-values. It returns false if the
+// client didn't advertise any coding we can produce.
+func acceptedCodec(aes []string) (Codec, bool) {
+	type candidate struct {
+		name string
+		q    float64
+	}
+
+	var candidates []candidate
+	for _, ae := range aes {
+		for _, part := range strings.Split(ae, ",") {
+			name, q := parseQValue(part)
+			if name == "" {
+				continue
+			}
+			if _, ok := codecs[name]; !ok {
+				continue
+			}
+			candidates = append(candidates, candidate{name, q})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	best := candidates[0]
+	if best.q == 0 {
+		return nil, false
+	}
+	return codecs[best.name], true
+}
+
+// parseQValue parses a single Accept-Encoding element such as
+// "br;q=0.8" into its coding name and q-value, defaulting q to 1.
+func parseQValue(part string) (name string, q float64) {
+	fields := strings.Split(part, ";")
+	name = strings.TrimSpace(fields[0])
+	if name == "" {
+		return "", 0
+	}
+
+	q = 1
+	for _, f := range fields[1:] {
+		f = strings.TrimSpace(f)
+		if !strings.HasPrefix(f, "q=") {
+			continue
+		}
+		if parsed, err := strconv.ParseFloat(strings.TrimPrefix(f, "q="), 64); err == nil {
+			q = parsed
+		}
+	}
+	return name, q
+}
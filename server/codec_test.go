@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseQValue(t *testing.T) {
+	tests := []struct {
+		part     string
+		wantName string
+		wantQ    float64
+	}{
+		{"gzip", "gzip", 1},
+		{" gzip ", "gzip", 1},
+		{"br;q=0.8", "br", 0.8},
+		{"br; q=0.8", "br", 0.8},
+		{"zstd;q=0", "zstd", 0},
+		{"identity;q=1.0", "identity", 1},
+		{"br;q=not-a-number", "br", 1},
+		{"", "", 0},
+	}
+
+	for _, tt := range tests {
+		gotName, gotQ := parseQValue(tt.part)
+		if gotName != tt.wantName || gotQ != tt.wantQ {
+			t.Errorf("parseQValue(%q) = (%q, %v), want (%q, %v)",
+				tt.part, gotName, gotQ, tt.wantName, tt.wantQ)
+		}
+	}
+}
+
+func TestAcceptedCodec(t *testing.T) {
+	tests := []struct {
+		name    string
+		aes     []string
+		wantOK  bool
+		wantEnc string
+	}{
+		{"highest q wins", []string{"gzip;q=0.5, br;q=0.9"}, true, "br"},
+		{"split across header values", []string{"gzip;q=0.5", "br;q=0.9"}, true, "br"},
+		{"unknown codings ignored", []string{"identity, compress;q=1.0, br;q=0.3"}, true, "br"},
+		{"q=0 rejects the coding", []string{"gzip;q=0"}, false, ""},
+		{"nothing we support", []string{"identity, compress"}, false, ""},
+		{"no header at all", nil, false, ""},
+		{"default q=1 beats explicit lower q", []string{"zstd;q=0.4, gzip"}, true, "gzip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, ok := acceptedCodec(tt.aes)
+			if ok != tt.wantOK {
+				t.Fatalf("acceptedCodec(%v) ok = %v, want %v", tt.aes, ok, tt.wantOK)
+			}
+			if ok && codec.Name() != tt.wantEnc {
+				t.Fatalf("acceptedCodec(%v) = %q, want %q", tt.aes, codec.Name(), tt.wantEnc)
+			}
+		})
+	}
+}
+
+func TestDecodeContent(t *testing.T) {
+	plain := []byte("the quick brown fox jumps over the lazy dog")
+
+	var gzipped bytes.Buffer
+	if err := (gzipCodec{}).Encode(&gzipped, plain); err != nil {
+		t.Fatalf("encoding fixture: %v", err)
+	}
+
+	var gzippedThenBrotlied bytes.Buffer
+	if err := (brotliCodec{}).Encode(&gzippedThenBrotlied, gzipped.Bytes()); err != nil {
+		t.Fatalf("encoding fixture: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ces  []string
+		body []byte
+	}{
+		{"single coding", []string{"gzip"}, gzipped.Bytes()},
+		{"split across header lines", []string{"gzip", "br"}, gzippedThenBrotlied.Bytes()},
+		{"comma-joined in one header line", []string{"gzip, br"}, gzippedThenBrotlied.Bytes()},
+		{"extra whitespace around the comma", []string{"gzip ,  br"}, gzippedThenBrotlied.Bytes()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeContent(tt.ces, tt.body)
+			if err != nil {
+				t.Fatalf("decodeContent(%v): %v", tt.ces, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("decodeContent(%v) = %q, want %q", tt.ces, got, plain)
+			}
+		})
+	}
+}
+
+func TestDecodeContentSkipsUnknownCodings(t *testing.T) {
+	plain := []byte("hello, world")
+	var gzipped bytes.Buffer
+	if err := (gzipCodec{}).Encode(&gzipped, plain); err != nil {
+		t.Fatalf("encoding fixture: %v", err)
+	}
+
+	got, err := decodeContent([]string{"identity, gzip"}, gzipped.Bytes())
+	if err != nil {
+		t.Fatalf("decodeContent: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("decodeContent with an unknown leading coding = %q, want %q", got, plain)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// SiteConfig maps one incoming Host header to an upstream origin, plus
+// the dictionary scope that origin's content should be trained under
+// (see dict.Scope). PathPrefix is optional and defaults to "/".
+type SiteConfig struct {
+	Host       string `json:"host"`
+	Upstream   string `json:"upstream"`
+	PathPrefix string `json:"path_prefix"`
+}
+
+// Config is the top-level shape of the proxy's config file: the set of
+// sites it fronts, keyed by the Host header clients will send.
+type Config struct {
+	Sites []SiteConfig `json:"sites"`
+}
+
+// LoadConfig reads and validates a Config from a JSON file.
+func LoadConfig(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+
+	var cfg Config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return Config{}, err
+	}
+
+	seen := make(map[string]bool, len(cfg.Sites))
+	for i, site := range cfg.Sites {
+		if site.Host == "" {
+			return Config{}, fmt.Errorf("config: site %d: missing host", i)
+		}
+		if seen[site.Host] {
+			return Config{}, fmt.Errorf("config: duplicate host %q", site.Host)
+		}
+		seen[site.Host] = true
+
+		if _, err := url.Parse(site.Upstream); err != nil {
+			return Config{}, fmt.Errorf("config: site %s: invalid upstream: %v", site.Host, err)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rakoo/mmas/pkg/dict"
+)
+
+// ResponseCondition decides whether a registered handler should run
+// against a given upstream response. Modeled on goproxy's
+// OnResponse(...).DoFunc(...) pattern.
+type ResponseCondition interface {
+	Handle(resp *http.Response) bool
+}
+
+// ResponseConditionFunc adapts a plain function to a ResponseCondition.
+type ResponseConditionFunc func(resp *http.Response) bool
+
+func (f ResponseConditionFunc) Handle(resp *http.Response) bool { return f(resp) }
+
+// ContentTypeIs returns a ResponseCondition matching any response whose
+// Content-Type starts with one of types.
+func ContentTypeIs(types ...string) ResponseCondition {
+	return ResponseConditionFunc(func(resp *http.Response) bool {
+		ct := resp.Header.Get("Content-Type")
+		for _, t := range types {
+			if strings.HasPrefix(ct, t) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ResponseContext carries the per-request state a response handler needs
+// beyond the response itself: which inbound request produced it, which
+// site it belongs to, and the dictionary store to train/diff against.
+type ResponseContext struct {
+	Req   *http.Request
+	Site  SiteConfig
+	Store *dict.DictStore
+}
+
+// ResponseHandlerFunc transforms resp, returning the (possibly different)
+// response to pass to the next handler in the chain.
+type ResponseHandlerFunc func(resp *http.Response, ctx *ResponseContext) (*http.Response, error)
+
+type responseHandler struct {
+	cond ResponseCondition
+	fn   ResponseHandlerFunc
+}
+
+// Handle registers fn to run on every response matching cond, in
+// registration order. The built-in SDCH encoding step is itself just the
+// first handler registered by newSDCHProxy; callers can add their own
+// (charset conversion, HTML rewriting, header injection, ...) without
+// touching ServeHTTP.
+func (s *SDCHProxy) Handle(cond ResponseCondition, fn ResponseHandlerFunc) {
+	s.handlers = append(s.handlers, responseHandler{cond, fn})
+}
+
+// runHandlers passes resp through every registered handler whose
+// condition matches, in order, each one seeing the previous one's output.
+func (s *SDCHProxy) runHandlers(resp *http.Response, ctx *ResponseContext) (*http.Response, error) {
+	for _, h := range s.handlers {
+		if !h.cond.Handle(resp) {
+			continue
+		}
+		next, err := h.fn(resp, ctx)
+		if err != nil {
+			return resp, err
+		}
+		resp = next
+	}
+	return resp, nil
+}
+
+// withBody returns a shallow copy of resp with its body replaced by body,
+// and Content-Length updated to match.
+func withBody(resp *http.Response, body []byte) *http.Response {
+	out := new(http.Response)
+	*out = *resp
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	out.Header = resp.Header.Clone()
+	out.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return out
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestContentTypeIs(t *testing.T) {
+	cond := ContentTypeIs("text/html", "application/json")
+
+	tests := []struct {
+		ct   string
+		want bool
+	}{
+		{"text/html", true},
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"text/css", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Content-Type": []string{tt.ct}}}
+		if got := cond.Handle(resp); got != tt.want {
+			t.Errorf("ContentTypeIs(...).Handle(Content-Type: %q) = %v, want %v", tt.ct, got, tt.want)
+		}
+	}
+}
+
+func TestRunHandlersOrderAndSkipping(t *testing.T) {
+	var order []string
+	proxy := &SDCHProxy{}
+
+	proxy.Handle(ContentTypeIs("text/html"), func(resp *http.Response, ctx *ResponseContext) (*http.Response, error) {
+		order = append(order, "html-1")
+		return resp, nil
+	})
+	proxy.Handle(ContentTypeIs("application/json"), func(resp *http.Response, ctx *ResponseContext) (*http.Response, error) {
+		order = append(order, "json")
+		return resp, nil
+	})
+	proxy.Handle(ContentTypeIs("text/html"), func(resp *http.Response, ctx *ResponseContext) (*http.Response, error) {
+		order = append(order, "html-2")
+		return withBody(resp, []byte("rewritten")), nil
+	})
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": []string{"text/html"}},
+		Body:   ioutil.NopCloser(nil),
+	}
+	out, err := proxy.runHandlers(resp, &ResponseContext{})
+	if err != nil {
+		t.Fatalf("runHandlers: %v", err)
+	}
+
+	wantOrder := []string{"html-1", "html-2"}
+	if len(order) != len(wantOrder) {
+		t.Fatalf("ran handlers %v, want %v", order, wantOrder)
+	}
+	for i := range wantOrder {
+		if order[i] != wantOrder[i] {
+			t.Fatalf("ran handlers %v, want %v", order, wantOrder)
+		}
+	}
+
+	body, _ := ioutil.ReadAll(out.Body)
+	if string(body) != "rewritten" {
+		t.Fatalf("expected the last handler's output to win, got body %q", body)
+	}
+}
+
+func TestWithBodySetsContentLengthHeader(t *testing.T) {
+	resp := &http.Response{
+		Header: http.Header{"Content-Length": []string{"999"}},
+		Body:   ioutil.NopCloser(nil),
+	}
+
+	out := withBody(resp, []byte("short"))
+
+	if got := out.Header.Get("Content-Length"); got != "5" {
+		t.Fatalf("Content-Length header = %q, want %q", got, "5")
+	}
+	if out.ContentLength != 5 {
+		t.Fatalf("ContentLength field = %d, want 5", out.ContentLength)
+	}
+}
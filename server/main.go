@@ -2,10 +2,8 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"fmt"
+	"flag"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -13,49 +11,72 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 
 	"github.com/rakoo/mmas/pkg/dict"
 )
 
 type SDCHProxy struct {
-	proxy  *httputil.ReverseProxy
-	d      *dict.Dict
-	target *url.URL
+	proxy    *httputil.ReverseProxy
+	store    *dict.DictStore
+	sites    map[string]SiteConfig
+	handlers []responseHandler
 }
 
-func newSDCHProxy(target *url.URL) SDCHProxy {
-	iproxy := httputil.NewSingleHostReverseProxy(target)
-	pDirector := iproxy.Director
-	iproxy.Director = func(r *http.Request) {
-		pDirector(r)
-		r.Host = r.URL.Host
+func newSDCHProxy(cfg Config, store *dict.DictStore) *SDCHProxy {
+	targets := make(map[string]*url.URL, len(cfg.Sites))
+	sites := make(map[string]SiteConfig, len(cfg.Sites))
+	for _, site := range cfg.Sites {
+		u, err := url.Parse(site.Upstream)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets[site.Host] = u
+		sites[site.Host] = site
 	}
 
-	d, err := dict.New()
-	if err != nil {
-		log.Fatal(err)
+	iproxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			target, ok := targets[r.Host]
+			if !ok {
+				return
+			}
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.URL.Path = path.Join(target.Path, r.URL.Path)
+			r.Host = target.Host
+		},
 	}
-	return SDCHProxy{
-		proxy:  iproxy,
-		d:      d,
-		target: target,
+
+	p := &SDCHProxy{
+		proxy: iproxy,
+		store: store,
+		sites: sites,
 	}
+	p.Handle(ContentTypeIs("text/html", "application/json", "text/css", "application/javascript"), sdchEncode)
+	return p
 }
 
-func (s SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, "/_sdch") {
 		s.serveDict(w, r)
 		return
 	}
 
+	site, ok := s.sites[r.Host]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
 	canSdch := false
 	w.Header().Set("X-Sdch-Encode", "0")
 
-	if len(s.d.SdchHeader) > 0 {
-		path := fmt.Sprintf("/_sdch/%s", s.d.DictName())
-		w.Header().Set("Get-Dictionary", path)
+	// We don't know the response's content-type until we've fetched it,
+	// but html is by far the common case and worth advertising up front
+	// so the client can fetch the dictionary in parallel with the page.
+	if dictPath, ok := getDictionaryHeader(s.store, r.Host, r.URL.Path); ok {
+		w.Header().Set("Get-Dictionary", dictPath)
 	}
 
 	aes := r.Header["Accept-Encoding"]
@@ -75,105 +96,45 @@ func (s SDCHProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	rr := httptest.NewRecorder()
 	s.proxy.ServeHTTP(rr, r)
-	copyHeader(w.Header(), rr.Header())
-
-	isTextHtml := false
-	cts := rr.Header()["Content-Type"]
-	for _, ct := range cts {
-		if strings.HasPrefix(ct, "text/html") {
-			isTextHtml = true
-		}
-	}
-
-	if !isTextHtml {
-		io.Copy(w, rr.Body)
-		return
-	}
-
-	// Read content, ungzip it if needed
-	originalContent := rr.Body.Bytes()
-	workContent := originalContent
-
-	ces := rr.Header()["Content-Encoding"]
-	hasGzip := false
-	for _, ce := range ces {
-		if ce == "gzip" {
-			hasGzip = true
-			break
-		}
-	}
-	if hasGzip {
-		gzr, err := gzip.NewReader(rr.Body)
-		if err != nil {
-			httpError(w)
-			return
-		}
-		workContent, err = ioutil.ReadAll(gzr)
-		if err != nil {
-			httpError(w)
-			return
-		}
-	}
+	resp := rr.Result()
 
-	diff, err := s.d.Eat(workContent)
+	ctx := &ResponseContext{Req: r, Site: site, Store: s.store}
+	resp, err := s.runHandlers(resp, ctx)
 	if err != nil {
-		if err != dict.ErrNoDict {
-			log.Println("Error eating:", err)
-		}
-		// If all else fails, return original response
-		w.Write(originalContent)
+		log.Println("Error running response handlers:", err)
+		httpError(w)
 		return
 	}
 
-	newContent := originalContent
-	if hasGzip {
-		var buf bytes.Buffer
-		gzw := gzip.NewWriter(&buf)
-		gzw.Write(diff)
-		gzw.Flush()
-		newContent = buf.Bytes()
+	copyHeader(w.Header(), resp.Header)
+	if resp.Header.Get("Content-Encoding") == "sdch" {
+		w.Header().Del("X-Sdch-Encode")
 	}
+	io.Copy(w, resp.Body)
+}
 
-	ratio := 100 * float64(len(newContent)) / float64(len(originalContent))
-	log.Printf("Ratio: %d/%d (%f%%)", len(newContent), len(originalContent), ratio)
-
-	if len(newContent) > len(originalContent) {
-		w.Write(originalContent)
+func (s *SDCHProxy) serveDict(w http.ResponseWriter, r *http.Request) {
+	name := strings.Replace(r.URL.Path, "/_sdch/", "", 1)
+	d, ok := s.store.ByName(name)
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
 
-	// Like Chrome, we only take the first one
-	uaId := r.Header.Get("Avail-Dictionary")
-	if len(uaId) == 0 || uaId != string(s.d.UserAgentId()) {
-		log.Printf("UA wants %s, we have %s\n", uaId, s.d.UserAgentId())
-		w.Write(originalContent)
+	header, ok := d.Generation(name)
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
 
-	w.Header().Set("Content-Encoding", "sdch")
-	if hasGzip {
-		w.Header().Add("Content-Encoding", "gzip")
-	}
-	w.Header().Del("X-Sdch-Encode")
-
-	serverId := s.d.ServerId()
-	cl := strconv.Itoa(len(serverId) + 1 + len(newContent))
-	w.Header().Set("Content-Length", cl)
-	w.Write(serverId)
-	w.Write([]byte{0})
-	w.Write(newContent)
-}
-
-func (s SDCHProxy) serveDict(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
-	_, err := buf.Write(s.d.SdchHeader)
+	_, err := buf.Write(header)
 	if err != nil {
 		httpError(w)
 		return
 	}
 
-	name := strings.Replace(r.URL.Path, "/_sdch/", "", 1)
-	f, err := os.Open(path.Join("dicts", name))
+	f, err := os.Open(d.ContentPath(name))
 	if err != nil {
 		httpError(w)
 		return
@@ -209,11 +170,16 @@ func httpError(w http.ResponseWriter) {
 }
 
 func main() {
-	u, err := url.Parse("https://en.wikipedia.org/")
+	configPath := flag.String("config", "sites.json", "path to the sites config file")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	proxy := newSDCHProxy(u)
+
+	store := dict.NewStore("dicts")
+	proxy := newSDCHProxy(cfg, store)
 
 	log.Println("Let's go !")
 	log.Fatal(http.ListenAndServe(":8080", proxy))
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/rakoo/mmas/pkg/dict"
+)
+
+// normalizeContentType strips any parameters (e.g. "; charset=utf-8")
+// from a Content-Type header value, so scoping doesn't fragment a
+// dictionary by charset variations of the same type.
+func normalizeContentType(ct string) string {
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.TrimSpace(ct)
+}
+
+// sdchEncode is the built-in response handler that does the actual SDCH
+// dictionary diffing. It's registered by newSDCHProxy against
+// ContentTypeIs("text/html", "application/json", "text/css",
+// "application/javascript") — the same handler chain users can add their
+// own handlers to.
+func sdchEncode(resp *http.Response, ctx *ResponseContext) (*http.Response, error) {
+	d, err := ctx.Store.Get(dict.Scope{
+		Host:        ctx.Req.Host,
+		PathPrefix:  ctx.Site.PathPrefix,
+		ContentType: normalizeContentType(resp.Header.Get("Content-Type")),
+	})
+	if err != nil {
+		return resp, nil
+	}
+
+	originalContent, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	workContent, err := decodeContent(resp.Header["Content-Encoding"], originalContent)
+	if err != nil {
+		return withBody(resp, originalContent), nil
+	}
+
+	// We only ever diff against a generation the client told us it
+	// already holds; otherwise it has no dictionary to decode the delta
+	// against. Avail-Dictionary can list more than one id (the client
+	// may be holding dictionaries for several scopes on this host), so
+	// consult all of them and use the first one this Dict still
+	// recognizes.
+	uaId := bestAvailDictionary(ctx.Req.Header["Avail-Dictionary"], d)
+	diff, genId, err := d.Eat(workContent, uaId)
+	if err != nil {
+		if err != dict.ErrNoDict && err != dict.ErrUnknownGeneration {
+			log.Println("Error eating:", err)
+		}
+		return withBody(resp, originalContent), nil
+	}
+
+	// Re-encode the diff with the best codec the client advertised, so we
+	// compose "Content-Encoding: sdch, <codec>" below.
+	outer, hasOuter := acceptedCodec(ctx.Req.Header["Accept-Encoding"])
+	var newContent []byte
+	if hasOuter {
+		var buf bytes.Buffer
+		if err := outer.Encode(&buf, diff); err != nil {
+			return withBody(resp, originalContent), nil
+		}
+		newContent = buf.Bytes()
+	} else {
+		newContent = diff
+	}
+
+	ratio := 100 * float64(len(newContent)) / float64(len(originalContent))
+	log.Printf("Ratio: %d/%d (%f%%)", len(newContent), len(originalContent), ratio)
+
+	if len(newContent) > len(originalContent) {
+		return withBody(resp, originalContent), nil
+	}
+
+	var body bytes.Buffer
+	body.WriteString(genId)
+	body.WriteByte(0)
+	body.Write(newContent)
+
+	out := withBody(resp, body.Bytes())
+	out.Header.Set("Content-Encoding", "sdch")
+	if hasOuter {
+		out.Header.Add("Content-Encoding", outer.Name())
+	}
+	out.Header.Del("X-Sdch-Encode")
+	return out, nil
+}
+
+// bestAvailDictionary parses the (possibly multi-valued, comma-joined)
+// Avail-Dictionary header and returns the first id the client listed that
+// names a generation d can still encode against. A client can hold
+// dictionaries for more than one scope on the same host, so we can't
+// assume the first id in the first header value is the one that applies
+// here.
+func bestAvailDictionary(headers []string, d *dict.Dict) string {
+	for _, h := range headers {
+		for _, id := range strings.Split(h, ",") {
+			id = strings.TrimSpace(id)
+			if id != "" && d.HasGeneration(id) {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// getDictionaryHeader returns the Get-Dictionary value for ServeHTTP to
+// set ahead of fetching the upstream response when a dictionary already
+// exists for the request's host and path, letting the client fetch the
+// dictionary in parallel with the
+// page. It uses DictStore.Lookup rather than Get so that guessing wrong
+// about the response's eventual content-type doesn't spin up an empty
+// scope we'll never otherwise use.
+func getDictionaryHeader(store *dict.DictStore, host, reqPath string) (string, bool) {
+	d, ok := store.Lookup(host, reqPath, "text/html")
+	if !ok || len(d.CurrentHeader()) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("/_sdch/%s", d.DictName()), true
+}